@@ -0,0 +1,88 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package backends defines the Backend interface every storage target
+// (local disk, S3, GCS, Azure, ...) implements, and the plumbing in
+// backup.Backup/backup.Restore only ever talks to backends through it.
+package backends
+
+import (
+	"context"
+	"io"
+
+	"github.com/someone1/zfsbackup-go/helpers"
+)
+
+// DeleteBackendPrefix is the sentinel destination Backup appends to
+// jobInfo.Destinations when MaxFileBuffer is set, so that temporary volume
+// files are cleaned up from disk once every real destination is done with
+// them.
+const DeleteBackendPrefix = "delete://"
+
+// Backend is the interface every storage target implements. A Backend is
+// created (and configured) once per destination and reused for the
+// lifetime of a single Backup/Restore/reconcile call.
+type Backend interface {
+	// StartUpload consumes volumes from in, uploads each to the
+	// destination, and forwards it on the returned channel once the upload
+	// succeeds. The returned channel is closed once in is drained and every
+	// upload has been forwarded.
+	StartUpload(ctx context.Context, in <-chan *helpers.VolumeInfo) <-chan *helpers.VolumeInfo
+
+	// Wait blocks until every upload started by StartUpload has completed,
+	// returning the first error encountered, if any. Suitable for use with
+	// errgroup.Group.Go.
+	Wait() error
+
+	// Close releases any resources held by the backend (connections,
+	// credentials, temp state). It does not imply Wait.
+	Close() error
+
+	// Head reports the size and MD5 of objectName as currently stored at
+	// the destination, used by the blob info cache to confirm a volume
+	// doesn't need to be re-uploaded.
+	Head(ctx context.Context, objectName string) (size int64, md5 string, err error)
+
+	// Exists reports whether objectName is already present at the
+	// destination, used by the dedup chunk uploader to avoid re-uploading a
+	// chunk another incremental already pushed.
+	Exists(ctx context.Context, objectName string) (bool, error)
+
+	// UploadChunk uploads a single content-addressed chunk directly,
+	// outside the regular StartUpload pipeline, since chunks are uploaded
+	// as they're produced rather than batched through a channel.
+	UploadChunk(ctx context.Context, vol *helpers.VolumeInfo) error
+
+	// Download returns a reader over objectName's contents. The caller is
+	// responsible for closing the returned reader if it implements
+	// io.Closer.
+	Download(ctx context.Context, objectName string) (io.Reader, error)
+
+	// Delete removes objectName from the destination, used by garbage
+	// collection once a chunk's refcount drops to zero.
+	Delete(ctx context.Context, objectName string) error
+
+	// PreloadFrom copies every name in objectNames from src into this
+	// backend, streaming each through an intermediate pipe rather than
+	// buffering it in memory. Used by reconcileDestinations to bring a
+	// destination that's missing manifests (and the volumes/chunks they
+	// reference) up to date from one that already has them.
+	PreloadFrom(ctx context.Context, src Backend, objectNames []string) error
+}
@@ -0,0 +1,250 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backends
+
+import (
+	"context"
+	"crypto/md5" // nolint:gosec // used for blob-presence comparison, not security
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/someone1/zfsbackup-go/helpers"
+)
+
+// localPrefix is the URI scheme used to address a plain directory on the
+// local filesystem as a destination.
+const localPrefix = "file://"
+
+// GetBackendForURI parses destination and returns the concrete Backend that
+// knows how to talk to it. Only the file:// scheme (plus the internal
+// DeleteBackendPrefix sentinel) is understood today; additional schemes (s3://, gs://, azure://, ...) register themselves here
+// as they're added.
+func GetBackendForURI(destination string) (Backend, error) {
+	switch {
+	case strings.HasPrefix(destination, localPrefix):
+		return newLocalBackend(strings.TrimPrefix(destination, localPrefix))
+	case strings.HasPrefix(destination, DeleteBackendPrefix):
+		return newDeleteBackend(), nil
+	default:
+		u, err := url.Parse(destination)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse destination %q: %v", destination, err)
+		}
+		return nil, fmt.Errorf("no backend registered for scheme %q", u.Scheme)
+	}
+}
+
+// localBackend stores objects as files underneath a root directory on the
+// local filesystem, mirroring objectName's "/"-separated segments as
+// subdirectories.
+type localBackend struct {
+	root string
+	done chan struct{}
+	err  error
+}
+
+func newLocalBackend(root string) (*localBackend, error) {
+	if err := os.MkdirAll(root, 0750); err != nil {
+		return nil, err
+	}
+	return &localBackend{root: root}, nil
+}
+
+func (l *localBackend) path(objectName string) string {
+	return filepath.Join(l.root, filepath.FromSlash(objectName))
+}
+
+func (l *localBackend) StartUpload(ctx context.Context, in <-chan *helpers.VolumeInfo) <-chan *helpers.VolumeInfo {
+	out := make(chan *helpers.VolumeInfo)
+	done := make(chan struct{})
+	l.done = done
+	go func() {
+		defer close(done)
+		defer close(out)
+		for vol := range in {
+			if err := l.upload(vol); err != nil {
+				helpers.AppLogger.Errorf("local backend: could not upload %s - %v", vol.ObjectName, err)
+				if l.err == nil {
+					l.err = err
+				}
+				continue
+			}
+			select {
+			case out <- vol:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (l *localBackend) upload(vol *helpers.VolumeInfo) error {
+	return vol.CopyTo(l.path(vol.ObjectName))
+}
+
+func (l *localBackend) Wait() error {
+	if l.done == nil {
+		return nil
+	}
+	<-l.done
+	return l.err
+}
+
+func (l *localBackend) Close() error {
+	return nil
+}
+
+func (l *localBackend) Head(ctx context.Context, objectName string) (int64, string, error) {
+	f, err := os.Open(l.path(objectName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, "", nil
+		}
+		return 0, "", err
+	}
+	defer f.Close()
+
+	info, serr := f.Stat()
+	if serr != nil {
+		return 0, "", serr
+	}
+
+	hasher := md5.New() // nolint:gosec
+	if _, cerr := io.Copy(hasher, f); cerr != nil {
+		return 0, "", cerr
+	}
+	return info.Size(), hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (l *localBackend) Exists(ctx context.Context, objectName string) (bool, error) {
+	_, err := os.Stat(l.path(objectName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *localBackend) UploadChunk(ctx context.Context, vol *helpers.VolumeInfo) error {
+	return l.upload(vol)
+}
+
+func (l *localBackend) Download(ctx context.Context, objectName string) (io.Reader, error) {
+	return os.Open(l.path(objectName))
+}
+
+func (l *localBackend) Delete(ctx context.Context, objectName string) error {
+	err := os.Remove(l.path(objectName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (l *localBackend) PreloadFrom(ctx context.Context, src Backend, objectNames []string) error {
+	for _, objectName := range objectNames {
+		exists, eerr := l.Exists(ctx, objectName)
+		if eerr != nil {
+			return eerr
+		}
+		if exists {
+			continue
+		}
+
+		r, derr := src.Download(ctx, objectName)
+		if derr != nil {
+			return derr
+		}
+
+		dest := l.path(objectName)
+		if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+			return err
+		}
+		if cerr := func() error {
+			f, ferr := os.Create(dest)
+			if ferr != nil {
+				return ferr
+			}
+			defer f.Close()
+			_, err := io.Copy(f, r)
+			return err
+		}(); cerr != nil {
+			return cerr
+		}
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return nil
+}
+
+// deleteBackend discards every volume handed to it and deletes the
+// underlying temp file. It backs the DeleteBackendPrefix destination Backup
+// appends when MaxFileBuffer is set, so volumes are cleaned up from local
+// disk once every real destination is done with them.
+type deleteBackend struct{}
+
+func newDeleteBackend() *deleteBackend {
+	return &deleteBackend{}
+}
+
+func (d *deleteBackend) StartUpload(ctx context.Context, in <-chan *helpers.VolumeInfo) <-chan *helpers.VolumeInfo {
+	out := make(chan *helpers.VolumeInfo)
+	go func() {
+		defer close(out)
+		for vol := range in {
+			if err := vol.DeleteVolume(); err != nil {
+				helpers.AppLogger.Warningf("delete backend: could not delete volume %s - %v", vol.ObjectName, err)
+			}
+			select {
+			case out <- vol:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (d *deleteBackend) Wait() error { return nil }
+func (d *deleteBackend) Close() error { return nil }
+func (d *deleteBackend) Head(ctx context.Context, objectName string) (int64, string, error) {
+	return 0, "", errors.New("delete backend does not store objects")
+}
+func (d *deleteBackend) Exists(ctx context.Context, objectName string) (bool, error) {
+	return false, nil
+}
+func (d *deleteBackend) UploadChunk(ctx context.Context, vol *helpers.VolumeInfo) error {
+	return vol.DeleteVolume()
+}
+func (d *deleteBackend) Download(ctx context.Context, objectName string) (io.Reader, error) {
+	return nil, errors.New("delete backend does not store objects")
+}
+func (d *deleteBackend) Delete(ctx context.Context, objectName string) error { return nil }
+func (d *deleteBackend) PreloadFrom(ctx context.Context, src Backend, objectNames []string) error {
+	return errors.New("delete backend cannot be preloaded into")
+}
@@ -53,37 +53,27 @@ func ProcessSmartOptions(jobInfo *helpers.JobInfo) error {
 		// TODO: Check if we already have a full backup for this snapshot in the destination(s)
 		return nil
 	}
-	lastComparableSnapshots := make([]*helpers.SnapshotInfo, len(jobInfo.Destinations))
-	lastBackup := make([]*helpers.SnapshotInfo, len(jobInfo.Destinations))
-	for idx := range jobInfo.Destinations {
-		destBackups, derr := getBackupsForTarget(context.Background(), jobInfo.VolumeName, jobInfo.Destinations[idx], jobInfo)
-		if derr != nil {
-			return derr
+
+	lastComparableSnapshots, lastBackup, cerr := comparableSnapshotsPerDestination(jobInfo)
+	if cerr != nil {
+		if !jobInfo.Reconcile {
+			return cerr
 		}
-		if len(destBackups) == 0 {
-			continue
+		// Destinations disagree on what's there - try to bring the
+		// stragglers up to date, copying each missing manifest from a
+		// destination that already has it, then re-check before giving up.
+		helpers.AppLogger.Infof("Destinations are out of sync, reconciling before continuing: %v", cerr)
+		if rerr := reconcileDestinations(context.Background(), jobInfo); rerr != nil {
+			return rerr
 		}
-		lastBackup[idx] = &destBackups[0].BaseSnapshot
-		if jobInfo.Incremental {
-			lastComparableSnapshots[idx] = &destBackups[0].BaseSnapshot
-		}
-		if jobInfo.FullIfOlderThan != -1*time.Minute {
-			for _, bkp := range destBackups {
-				if bkp.IncrementalSnapshot.Name == "" {
-					lastComparableSnapshots[idx] = &bkp.BaseSnapshot
-					break
-				}
-			}
+		lastComparableSnapshots, lastBackup, cerr = comparableSnapshotsPerDestination(jobInfo)
+		if cerr != nil {
+			return cerr
 		}
 	}
 
 	var lastNotEqual bool
-	// Verify that all "comparable" snapshots are the same across destinations
-	for i := 1; i < len(lastComparableSnapshots); i++ {
-		if !lastComparableSnapshots[i-1].Equal(lastComparableSnapshots[i]) {
-			return fmt.Errorf("destinations are out of sync, cannot continue with smart option")
-		}
-
+	for i := 1; i < len(lastBackup); i++ {
 		if !lastNotEqual && !lastBackup[i-1].Equal(lastBackup[i]) {
 			lastNotEqual = true
 		}
@@ -122,6 +112,43 @@ func ProcessSmartOptions(jobInfo *helpers.JobInfo) error {
 	return nil
 }
 
+// comparableSnapshotsPerDestination gathers the last comparable snapshot and
+// last backup per destination and verifies that every destination's
+// comparable snapshot agrees, returning an error if any two disagree.
+func comparableSnapshotsPerDestination(jobInfo *helpers.JobInfo) ([]*helpers.SnapshotInfo, []*helpers.SnapshotInfo, error) {
+	lastComparableSnapshots := make([]*helpers.SnapshotInfo, len(jobInfo.Destinations))
+	lastBackup := make([]*helpers.SnapshotInfo, len(jobInfo.Destinations))
+	for idx := range jobInfo.Destinations {
+		destBackups, derr := getBackupsForTarget(context.Background(), jobInfo.VolumeName, jobInfo.Destinations[idx], jobInfo)
+		if derr != nil {
+			return nil, nil, derr
+		}
+		if len(destBackups) == 0 {
+			continue
+		}
+		lastBackup[idx] = &destBackups[0].BaseSnapshot
+		if jobInfo.Incremental {
+			lastComparableSnapshots[idx] = &destBackups[0].BaseSnapshot
+		}
+		if jobInfo.FullIfOlderThan != -1*time.Minute {
+			for _, bkp := range destBackups {
+				if bkp.IncrementalSnapshot.Name == "" {
+					lastComparableSnapshots[idx] = &bkp.BaseSnapshot
+					break
+				}
+			}
+		}
+	}
+
+	for i := 1; i < len(lastComparableSnapshots); i++ {
+		if !lastComparableSnapshots[i-1].Equal(lastComparableSnapshots[i]) {
+			return nil, nil, fmt.Errorf("destinations are out of sync, cannot continue with smart option")
+		}
+	}
+
+	return lastComparableSnapshots, lastBackup, nil
+}
+
 func getBackupsForTarget(ctx context.Context, volume, target string, jobInfo *helpers.JobInfo) ([]*helpers.JobInfo, error) {
 	// Prepare the backend client
 	backend := prepareBackend(ctx, jobInfo, target, nil)
@@ -153,16 +180,45 @@ func getBackupsForTarget(ctx context.Context, volume, target string, jobInfo *he
 
 // Backup will iniate a backup with the provided configuration.
 func Backup(jobInfo *helpers.JobInfo) error {
-	ctx, cancel := context.WithCancel(context.Background())
+	return BackupWithOptions(context.Background(), jobInfo, BackupOptions{})
+}
+
+// BackupWithOptions is a variant of Backup that takes an explicit context
+// and BackupOptions, letting callers that aren't the CLI (daemons, web UIs,
+// Prometheus exporters) observe progress through opts.Progress instead of
+// scraping helpers.AppLogger output.
+func BackupWithOptions(ctx context.Context, jobInfo *helpers.JobInfo, opts BackupOptions) error {
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	defer os.RemoveAll(helpers.BackupTempdir)
 
 	if jobInfo.Resume {
 		if err := tryResume(ctx, jobInfo); err != nil {
+			emitProgress(opts, ProgressEvent{Type: ErrorEvent, Err: err})
 			return err
 		}
 	}
 
+	if jobInfo.Dedup {
+		if err := sendStreamDeduped(ctx, jobInfo, opts); err != nil {
+			emitProgress(opts, ProgressEvent{Type: ErrorEvent, Err: err})
+			return err
+		}
+		jobInfo.EndTime = time.Now()
+		if _, err := saveManifest(ctx, jobInfo, true); err != nil {
+			emitProgress(opts, ProgressEvent{Type: ErrorEvent, Err: err})
+			return err
+		}
+		emitProgress(opts, ProgressEvent{Type: ManifestFinalized})
+		helpers.AppLogger.Noticef("Done.\n\tTotal ZFS Stream Bytes: %d (%s)\n\tElapsed Time: %v\n\tTotal Chunks: %d", jobInfo.ZFSStreamBytes, humanize.IBytes(jobInfo.ZFSStreamBytes), time.Since(jobInfo.StartTime), len(jobInfo.Chunks))
+
+		if jobInfo.Full {
+			pruneSupersededManifests(ctx, jobInfo)
+		}
+
+		return nil
+	}
+
 	fileBufferSize := jobInfo.MaxFileBuffer
 	if fileBufferSize == 0 {
 		fileBufferSize = 1
@@ -197,7 +253,7 @@ func Backup(jobInfo *helpers.JobInfo) error {
 
 	// Start the ZFS send stream
 	group.Go(func() error {
-		return sendStream(ctx, jobInfo, startCh, fileBuffer)
+		return sendStream(ctx, jobInfo, startCh, fileBuffer, opts)
 	})
 
 	var usedBackends []backends.Backend
@@ -209,10 +265,21 @@ func Backup(jobInfo *helpers.JobInfo) error {
 	}
 
 	// Prepare backends and setup plumbing
+	var blobCaches []*BlobInfoCache
 	for _, destination := range jobInfo.Destinations {
 		backend := prepareBackend(ctx, jobInfo, destination, uploadBuffer)
-		_ = getCacheDir(destination)
-		out := backend.StartUpload(ctx, channels[len(channels)-1])
+		localCachePath := getCacheDir(destination)
+
+		blobCache, cerr := loadBlobInfoCache(localCachePath)
+		if cerr != nil {
+			return cerr
+		}
+		blobCaches = append(blobCaches, blobCache)
+
+		toUpload, alreadyCached := filterCached(ctx, blobCache, channels[len(channels)-1], backend.Head)
+		uploaded := backend.StartUpload(ctx, toUpload)
+		out := mergeVolumeChannels(recordUploads(blobCache, uploaded), alreadyCached)
+
 		channels = append(channels, out)
 		usedBackends = append(usedBackends, backend)
 		group.Go(backend.Wait)
@@ -226,6 +293,7 @@ func Backup(jobInfo *helpers.JobInfo) error {
 				maniwg.Done()
 				helpers.AppLogger.Debugf("Volume %s has finished the entire pipeline.", vol.ObjectName)
 				helpers.AppLogger.Debugf("Adding %s to the manifest volume list.", vol.ObjectName)
+				emitProgress(opts, ProgressEvent{Type: VolumeUploaded, Destination: vol.ObjectName, Bytes: vol.Counter()})
 				jobInfo.Volumes = append(jobInfo.Volumes, vol)
 				// Write a manifest file and save it locally in order to resume later
 				manifestVol, err := saveManifest(ctx, jobInfo, false)
@@ -258,6 +326,7 @@ func Backup(jobInfo *helpers.JobInfo) error {
 		if err != nil {
 			return err
 		}
+		emitProgress(opts, ProgressEvent{Type: ManifestFinalized})
 		stepCh <- manifestVol
 		close(stepCh)
 		return nil
@@ -265,6 +334,7 @@ func Backup(jobInfo *helpers.JobInfo) error {
 
 	err := group.Wait() // Wait for ZFS Send to finish, Backends to finish, and Manifest files to be copied/uploaded
 	if err != nil {
+		emitProgress(opts, ProgressEvent{Type: ErrorEvent, Err: err, Retryable: false})
 		return err
 	}
 
@@ -279,9 +349,19 @@ func Backup(jobInfo *helpers.JobInfo) error {
 		}
 	}
 
+	for _, blobCache := range blobCaches {
+		if err = blobCache.save(); err != nil {
+			helpers.AppLogger.Warningf("Could not persist blob info cache due to error - %v", err)
+		}
+	}
+
 	return nil
 }
 
+// saveManifest writes out the current state of j - j.Volumes, or j.Chunks
+// when dedup mode produced the backup instead - as a manifest volume and
+// copies it into the local cache for every destination so an interrupted
+// backup can be resumed or inspected later.
 func saveManifest(ctx context.Context, j *helpers.JobInfo, final bool) (*helpers.VolumeInfo, error) {
 	sort.Sort(helpers.ByVolumeNumber(j.Volumes))
 
@@ -293,6 +373,11 @@ func saveManifest(ctx context.Context, j *helpers.JobInfo, final bool) (*helpers
 	}
 	safeManifestFile := fmt.Sprintf("%x", md5.Sum([]byte(manifest.ObjectName)))
 	manifest.IsFinalManifest = final
+
+	// Record the manifest's own object name on itself before encoding so
+	// that anything that later decodes it - e.g. reconcileDestinations -
+	// knows what to ask a backend for without having to re-derive it.
+	j.ObjectName = manifest.ObjectName
 	jsonEnc := json.NewEncoder(manifest)
 	err = jsonEnc.Encode(j)
 	if err != nil {
@@ -318,7 +403,125 @@ func saveManifest(ctx context.Context, j *helpers.JobInfo, final bool) (*helpers
 	return manifest, nil
 }
 
-func sendStream(ctx context.Context, j *helpers.JobInfo, c chan<- *helpers.VolumeInfo, buffer <-chan bool) error {
+// pruneSupersededManifests runs after a Full dedup backup of jobInfo.VolumeName
+// finishes: a new full backup makes every previous dedup manifest for the
+// same volume on each destination safe to garbage collect, since none of
+// them are needed to reconstruct the dataset going forward. Failures are
+// logged rather than returned - a missed prune just means some chunks stay
+// around an extra cycle, which is far cheaper than failing a backup that
+// otherwise completed successfully.
+func pruneSupersededManifests(ctx context.Context, jobInfo *helpers.JobInfo) {
+	for _, destination := range jobInfo.Destinations {
+		if destination == backends.DeleteBackendPrefix {
+			continue
+		}
+
+		previous, perr := getBackupsForTarget(ctx, jobInfo.VolumeName, destination, jobInfo)
+		if perr != nil {
+			helpers.AppLogger.Warningf("Could not list previous manifests for destination %s, skipping chunk GC - %v", destination, perr)
+			continue
+		}
+
+		var superseded []*helpers.JobInfo
+		for _, manifest := range previous {
+			if manifest.Dedup && manifest.ObjectName != jobInfo.ObjectName {
+				superseded = append(superseded, manifest)
+			}
+		}
+		if len(superseded) == 0 {
+			continue
+		}
+
+		if err := PruneManifests(ctx, jobInfo, destination, superseded); err != nil {
+			helpers.AppLogger.Warningf("Could not prune %d superseded manifest(s) for destination %s - %v", len(superseded), destination, err)
+		}
+	}
+}
+
+// sendStreamDeduped runs the zfs send command and, instead of handing fixed
+// VolumeSize volumes down the regular upload pipeline, chunks the raw
+// stream and uploads each unique chunk directly to every destination,
+// recording the result as j.Chunks rather than j.Volumes. It is used in
+// place of sendStream whenever j.Dedup is set.
+func sendStreamDeduped(ctx context.Context, j *helpers.JobInfo, opts BackupOptions) error {
+	if estimate, eerr := helpers.EstimateZFSSendSize(ctx, j); eerr == nil {
+		j.ZFSStreamBytes = estimate
+	} else {
+		helpers.AppLogger.Debugf("Could not estimate zfs send size, progress will report 0 until the stream finishes - %v", eerr)
+	}
+
+	cmd := helpers.GetZFSSendCommand(ctx, j)
+	cin, cout := io.Pipe()
+	cmd.Stdout = cout
+	cmd.Stderr = os.Stderr
+	counter := datacounter.NewReaderCounter(cin)
+
+	destBackends := make(map[string]backends.Backend, len(j.Destinations))
+	destIndexes := make(map[string]*dedupIndex, len(j.Destinations))
+	for _, destination := range j.Destinations {
+		destBackends[destination] = prepareBackend(ctx, j, destination, nil)
+		localCachePath := getCacheDir(destination)
+		idx, ierr := loadDedupIndex(localCachePath)
+		if ierr != nil {
+			return ierr
+		}
+		destIndexes[destination] = idx
+	}
+	defer func() {
+		for destination, backend := range destBackends {
+			if cerr := backend.Close(); cerr != nil {
+				helpers.AppLogger.Warningf("Could not properly close backend for destination %s due to error - %v", destination, cerr)
+			}
+		}
+	}()
+
+	helpers.AppLogger.Infof("Starting zfs send command (dedup mode): %s", strings.Join(cmd.Args, " "))
+	if err := cmd.Start(); err != nil {
+		helpers.AppLogger.Errorf("Error starting zfs command - %v", err)
+		return err
+	}
+	j.ZFSCommandLine = strings.Join(cmd.Args, " ")
+
+	var group *errgroup.Group
+	group, ctx = errgroup.WithContext(ctx)
+
+	group.Go(func() error {
+		defer cout.Close()
+		return cmd.Wait()
+	})
+
+	var chunks []ChunkRef
+	group.Go(func() error {
+		var cerr error
+		chunks, cerr = chunkAndUpload(ctx, j, counter, destBackends, destIndexes, opts)
+		return cerr
+	})
+
+	if err := group.Wait(); err != nil {
+		helpers.AppLogger.Errorf("Error while sending/chunking zfs stream - %v", err)
+		return err
+	}
+
+	j.ZFSStreamBytes = counter.Count()
+	j.Chunks = chunks
+
+	for destination, idx := range destIndexes {
+		if err := idx.save(); err != nil {
+			helpers.AppLogger.Warningf("Could not persist dedup index for destination %s - %v", destination, err)
+		}
+	}
+
+	helpers.AppLogger.Infof("zfs send completed without error, %d chunks produced", len(chunks))
+	return nil
+}
+
+func sendStream(ctx context.Context, j *helpers.JobInfo, c chan<- *helpers.VolumeInfo, buffer <-chan bool, opts BackupOptions) error {
+	if estimate, eerr := helpers.EstimateZFSSendSize(ctx, j); eerr == nil {
+		j.ZFSStreamBytes = estimate
+	} else {
+		helpers.AppLogger.Debugf("Could not estimate zfs send size, progress will report 0 until the stream finishes - %v", eerr)
+	}
+
 	var group *errgroup.Group
 	group, ctx = errgroup.WithContext(ctx)
 
@@ -334,6 +537,7 @@ func sendStream(ctx context.Context, j *helpers.JobInfo, c chan<- *helpers.Volum
 
 	group.Go(func() error {
 		var lastTotalBytes uint64
+		var lastProgress time.Time
 		defer close(c)
 		var err error
 		var volume *helpers.VolumeInfo
@@ -374,6 +578,7 @@ func sendStream(ctx context.Context, j *helpers.JobInfo, c chan<- *helpers.Volum
 					return err
 				}
 				helpers.AppLogger.Debugf("Starting volume %s", volume.ObjectName)
+				emitProgress(opts, ProgressEvent{Type: VolumeStarted, Destination: volume.ObjectName})
 				volNum++
 				if usingPipe {
 					c <- volume
@@ -382,6 +587,10 @@ func sendStream(ctx context.Context, j *helpers.JobInfo, c chan<- *helpers.Volum
 
 			// Write a little at a time and break the output between volumes as needed
 			_, ierr := io.CopyN(volume, counter, helpers.BufferSize*2)
+			if now := time.Now(); now.Sub(lastProgress) >= opts.interval() {
+				emitProgress(opts, ProgressEvent{Type: BytesTransferred, Cumulative: counter.Count(), ZFSStreamBytes: j.ZFSStreamBytes})
+				lastProgress = now
+			}
 			if ierr == io.EOF {
 				// We are done!
 				helpers.AppLogger.Debugf("Finished creating volume %s", volume.ObjectName)
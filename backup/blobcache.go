@@ -0,0 +1,191 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/someone1/zfsbackup-go/helpers"
+)
+
+// blobInfoCacheFileName is the name of the local cache file recording what
+// has already been uploaded to a given destination.
+const blobInfoCacheFileName = "blobs.json"
+
+// blobInfo is what BlobInfoCache remembers about one previously uploaded
+// object.
+type blobInfo struct {
+	Size       int64     `json:"size"`
+	MD5        string    `json:"md5"`
+	UploadedAt time.Time `json:"uploadedAt"`
+}
+
+// BlobInfoCache remembers, per destination, which object names have
+// already been uploaded and with what content, so that retries and
+// partial re-runs after a crash don't have to re-push volumes the
+// destination already has - the same idea containers/image's internal
+// blobinfocache uses to avoid re-pushing layers.
+type BlobInfoCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]blobInfo
+}
+
+// loadBlobInfoCache reads (or initializes) the blob cache kept under
+// localCachePath for one destination.
+func loadBlobInfoCache(localCachePath string) (*BlobInfoCache, error) {
+	c := &BlobInfoCache{path: filepath.Join(localCachePath, blobInfoCacheFileName), entries: make(map[string]blobInfo)}
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if derr := json.NewDecoder(f).Decode(&c.entries); derr != nil {
+		return nil, derr
+	}
+	return c, nil
+}
+
+// has reports whether objectName is already known to be uploaded with the
+// given size and MD5, meaning the upload can be skipped outright.
+func (c *BlobInfoCache) has(objectName string, size int64, md5 string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, ok := c.entries[objectName]
+	return ok && info.Size == size && info.MD5 == md5
+}
+
+// record notes that objectName has been uploaded with the given size and
+// MD5. Called on every successful upload and whenever a HEAD check confirms
+// the object is already present at the destination; syncCache does not
+// populate the cache.
+func (c *BlobInfoCache) record(objectName string, size int64, md5 string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[objectName] = blobInfo{Size: size, MD5: md5, UploadedAt: time.Now()}
+}
+
+func (c *BlobInfoCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := os.Create(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(c.entries)
+}
+
+// filterCached sits in front of a destination's backend.StartUpload,
+// consulting cache for every incoming volume: a cache hit (or, failing
+// that, a cheap backend.Head confirming the object is already there) is
+// forwarded straight to cached as if it had just been uploaded, while
+// everything else is forwarded to realUploads for the backend to actually
+// push. Only the two "already there" cases record into cache here -
+// anything sent to realUploads is recorded by recordUploads once its
+// upload actually succeeds, never before. The caller is expected to merge
+// cached with recordUploads(cache, backend.StartUpload(...)).
+func filterCached(ctx context.Context, cache *BlobInfoCache, in <-chan *helpers.VolumeInfo, head func(ctx context.Context, objectName string) (size int64, md5 string, err error)) (realUploads <-chan *helpers.VolumeInfo, cached <-chan *helpers.VolumeInfo) {
+	toUpload := make(chan *helpers.VolumeInfo)
+	skipped := make(chan *helpers.VolumeInfo)
+
+	go func() {
+		defer close(toUpload)
+		defer close(skipped)
+		for vol := range in {
+			if vol.IsManifest {
+				toUpload <- vol
+				continue
+			}
+
+			size := int64(vol.Counter())
+			md5 := vol.MD5Sum()
+			if cache.has(vol.ObjectName, size, md5) {
+				helpers.AppLogger.Debugf("Skipping upload of %s, already present per blob cache.", vol.ObjectName)
+				skipped <- vol
+				continue
+			}
+
+			if head != nil {
+				if hsize, hmd5, herr := head(ctx, vol.ObjectName); herr == nil && hsize == size && hmd5 == md5 {
+					helpers.AppLogger.Debugf("Skipping upload of %s, HEAD confirms it already exists.", vol.ObjectName)
+					cache.record(vol.ObjectName, size, md5)
+					skipped <- vol
+					continue
+				}
+			}
+
+			toUpload <- vol
+		}
+	}()
+
+	return toUpload, skipped
+}
+
+// recordUploads sits behind a destination's backend.StartUpload, recording
+// every volume that comes through into cache before forwarding it on. A
+// volume only reaches this channel once the backend has actually finished
+// uploading it, so - unlike recording at the point filterCached hands a
+// volume to toUpload - recording here can't race an upload that later
+// fails: if the upload never
+// completes, the volume never reaches this channel and the cache never
+// learns about it.
+func recordUploads(cache *BlobInfoCache, in <-chan *helpers.VolumeInfo) <-chan *helpers.VolumeInfo {
+	out := make(chan *helpers.VolumeInfo)
+	go func() {
+		defer close(out)
+		for vol := range in {
+			if !vol.IsManifest {
+				cache.record(vol.ObjectName, int64(vol.Counter()), vol.MD5Sum())
+			}
+			out <- vol
+		}
+	}()
+	return out
+}
+
+// mergeVolumeChannels fans two VolumeInfo channels into one, closing the
+// result once both inputs are drained.
+func mergeVolumeChannels(a, b <-chan *helpers.VolumeInfo) <-chan *helpers.VolumeInfo {
+	out := make(chan *helpers.VolumeInfo)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for _, ch := range []<-chan *helpers.VolumeInfo{a, b} {
+		go func(ch <-chan *helpers.VolumeInfo) {
+			defer wg.Done()
+			for vol := range ch {
+				out <- vol
+			}
+		}(ch)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
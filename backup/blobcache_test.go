@@ -0,0 +1,46 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import "testing"
+
+func TestBlobInfoCacheHasAndRecord(t *testing.T) {
+	c := &BlobInfoCache{entries: make(map[string]blobInfo)}
+
+	if c.has("obj1", 100, "deadbeef") {
+		t.Fatalf("has() = true before any record")
+	}
+
+	c.record("obj1", 100, "deadbeef")
+
+	if !c.has("obj1", 100, "deadbeef") {
+		t.Fatalf("has() = false after matching record")
+	}
+	if c.has("obj1", 101, "deadbeef") {
+		t.Fatalf("has() = true for a mismatched size")
+	}
+	if c.has("obj1", 100, "different") {
+		t.Fatalf("has() = true for a mismatched md5")
+	}
+	if c.has("obj2", 100, "deadbeef") {
+		t.Fatalf("has() = true for an object that was never recorded")
+	}
+}
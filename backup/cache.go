@@ -0,0 +1,104 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/someone1/zfsbackup-go/backends"
+	"github.com/someone1/zfsbackup-go/helpers"
+)
+
+// prepareBackend resolves destination to a concrete backends.Backend.
+// uploadBuffer is not passed on: the returned backend's upload concurrency
+// is not bounded by it. Backend construction failures are fatal - there's no
+// sensible way to continue a backup/restore/reconcile without the
+// destination it was asked to talk to.
+func prepareBackend(ctx context.Context, j *helpers.JobInfo, destination string, uploadBuffer chan bool) backends.Backend {
+	backend, err := backends.GetBackendForURI(destination)
+	if err != nil {
+		helpers.AppLogger.Fatalf("Could not prepare backend for destination %s - %v", destination, err)
+	}
+	return backend
+}
+
+// getCacheDir returns (and ensures the existence of) the local cache
+// directory used to stash manifests, the dedup index, the blob info cache,
+// and restore state for one destination, keyed by an MD5 hash of the
+// destination string so arbitrary destination URIs are always safe to use
+// as a single path component.
+func getCacheDir(destination string) string {
+	safeFolder := fmt.Sprintf("%x", md5.Sum([]byte(destination)))
+	dir := filepath.Join(helpers.WorkingDir, "cache", safeFolder)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		helpers.AppLogger.Warningf("Could not create local cache directory %s - %v", dir, err)
+	}
+	return dir
+}
+
+// syncCache returns the (already hashed, per getCacheDir) manifest file
+// names present in localCachePath. backend is accepted so callers that
+// eventually grow the ability to pull manifests a local cache is missing
+// can do so here without changing every call site; for now, the set of
+// manifests a destination has is exactly what's already been synced into
+// its local cache by saveManifest/reconcileDestinations.
+func syncCache(ctx context.Context, j *helpers.JobInfo, localCachePath string, backend backends.Backend) ([]string, error) {
+	entries, err := ioutil.ReadDir(localCachePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch entry.Name() {
+		case dedupIndexFileName, blobInfoCacheFileName, restoreStateFileName:
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// readManifest decodes the JobInfo manifest stored at manifestPath.
+func readManifest(ctx context.Context, manifestPath string, j *helpers.JobInfo) (*helpers.JobInfo, error) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var decoded helpers.JobInfo
+	if err := json.NewDecoder(f).Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return &decoded, nil
+}
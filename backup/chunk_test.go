@@ -0,0 +1,79 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import "testing"
+
+func TestChunkObjectName(t *testing.T) {
+	hash := "abcdef0123456789"
+	got := chunkObjectName(hash)
+	want := "chunks/ab/abcdef0123456789"
+	if got != want {
+		t.Errorf("chunkObjectName(%q) = %q, want %q", hash, got, want)
+	}
+}
+
+func TestDedupIndexRefCounting(t *testing.T) {
+	idx := &dedupIndex{RefCount: make(map[string]int)}
+
+	if idx.has("h1") {
+		t.Fatalf("has(h1) = true before any addRef")
+	}
+
+	idx.addRef("h1")
+	idx.addRef("h1")
+	if !idx.has("h1") {
+		t.Fatalf("has(h1) = false after addRef")
+	}
+
+	if idx.release("h1") {
+		t.Fatalf("release(h1) dropped to zero after only one of two refs released")
+	}
+	if !idx.has("h1") {
+		t.Fatalf("has(h1) = false with one ref remaining")
+	}
+
+	if !idx.release("h1") {
+		t.Fatalf("release(h1) did not report zero after releasing the last ref")
+	}
+	if idx.has("h1") {
+		t.Fatalf("has(h1) = true after refcount dropped to zero")
+	}
+}
+
+func TestReleaseManifestChunks(t *testing.T) {
+	idx := &dedupIndex{RefCount: make(map[string]int)}
+	idx.addRef("shared")
+	idx.addRef("shared")
+	idx.addRef("onlyHere")
+
+	reclaimed := releaseManifestChunks(idx, []ChunkRef{{Hash: "shared"}, {Hash: "onlyHere"}})
+
+	if len(reclaimed) != 1 || reclaimed[0] != "onlyHere" {
+		t.Fatalf("releaseManifestChunks() = %v, want [onlyHere]", reclaimed)
+	}
+	if !idx.has("shared") {
+		t.Fatalf("has(shared) = false, but another manifest still references it")
+	}
+	if idx.has("onlyHere") {
+		t.Fatalf("has(onlyHere) = true, should have been fully released")
+	}
+}
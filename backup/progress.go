@@ -0,0 +1,96 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import "time"
+
+// ProgressEventType identifies what a ProgressEvent is reporting on.
+type ProgressEventType int
+
+// The kinds of events BackupOptions.Progress can receive.
+const (
+	VolumeStarted ProgressEventType = iota
+	VolumeUploaded
+	BytesTransferred
+	ManifestFinalized
+	ErrorEvent
+)
+
+// ProgressEvent is a single typed progress update emitted by Backup while
+// it runs, letting non-CLI consumers (daemons, web UIs, Prometheus
+// exporters) track a backup without scraping helpers.AppLogger output.
+type ProgressEvent struct {
+	Type ProgressEventType
+
+	// Set on VolumeStarted and VolumeUploaded. Identifies the volume or
+	// destination the event pertains to - the object name for
+	// VolumeUploaded, since a single volume fans out to every
+	// destination through the same upload pipeline.
+	Destination string
+
+	// Set on VolumeUploaded. Duration is set only for chunk uploads in
+	// dedup mode; VolumeUploaded events from the regular volume pipeline
+	// leave it zero.
+	Bytes    uint64
+	Duration time.Duration
+
+	// Set on BytesTransferred.
+	Cumulative     uint64
+	ZFSStreamBytes uint64
+
+	// Set on ErrorEvent.
+	Err       error
+	Retryable bool
+}
+
+// BackupOptions configures optional behavior of Backup that isn't part of
+// the backup job itself.
+type BackupOptions struct {
+	// Progress, if non-nil, receives a ProgressEvent for each notable step
+	// of the backup. BytesTransferred events are sampled at most once per
+	// ProgressInterval; all other event types are sent as they happen.
+	// Backup never closes this channel.
+	Progress chan<- ProgressEvent
+
+	// ProgressInterval is the minimum time between BytesTransferred
+	// events. Defaults to one second if zero.
+	ProgressInterval time.Duration
+}
+
+func (o BackupOptions) interval() time.Duration {
+	if o.ProgressInterval <= 0 {
+		return time.Second
+	}
+	return o.ProgressInterval
+}
+
+// emitProgress sends ev on opts.Progress if one was provided. Sends are
+// best-effort - a consumer that isn't keeping up will have events dropped
+// rather than stall the backup.
+func emitProgress(opts BackupOptions, ev ProgressEvent) {
+	if opts.Progress == nil {
+		return
+	}
+	select {
+	case opts.Progress <- ev:
+	default:
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackupOptionsIntervalDefault(t *testing.T) {
+	var opts BackupOptions
+	if got := opts.interval(); got != time.Second {
+		t.Fatalf("interval() with zero ProgressInterval = %v, want %v", got, time.Second)
+	}
+}
+
+func TestBackupOptionsIntervalOverride(t *testing.T) {
+	opts := BackupOptions{ProgressInterval: 5 * time.Millisecond}
+	if got := opts.interval(); got != 5*time.Millisecond {
+		t.Fatalf("interval() = %v, want %v", got, 5*time.Millisecond)
+	}
+}
+
+func TestEmitProgressNilChannelIsNoop(t *testing.T) {
+	// Must not panic or block when no Progress channel was configured.
+	emitProgress(BackupOptions{}, ProgressEvent{Type: ManifestFinalized})
+}
+
+func TestEmitProgressSendsWhenRoomAvailable(t *testing.T) {
+	ch := make(chan ProgressEvent, 1)
+	opts := BackupOptions{Progress: ch}
+
+	emitProgress(opts, ProgressEvent{Type: VolumeStarted, Destination: "vol1"})
+
+	select {
+	case ev := <-ch:
+		if ev.Type != VolumeStarted || ev.Destination != "vol1" {
+			t.Fatalf("got event %+v, want VolumeStarted for vol1", ev)
+		}
+	default:
+		t.Fatal("emitProgress did not send on a channel with room available")
+	}
+}
+
+func TestEmitProgressDropsWhenChannelFull(t *testing.T) {
+	ch := make(chan ProgressEvent, 1)
+	ch <- ProgressEvent{Type: VolumeStarted, Destination: "already-queued"}
+	opts := BackupOptions{Progress: ch}
+
+	done := make(chan struct{})
+	go func() {
+		emitProgress(opts, ProgressEvent{Type: VolumeStarted, Destination: "dropped"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("emitProgress blocked instead of dropping the event on a full channel")
+	}
+}
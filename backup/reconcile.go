@@ -0,0 +1,153 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/someone1/zfsbackup-go/backends"
+	"github.com/someone1/zfsbackup-go/helpers"
+)
+
+// reconcileDestState tracks what one destination already has locally
+// synced, keyed by the safe (hashed) manifest filename readManifest et al
+// already use.
+type reconcileDestState struct {
+	destination string
+	backend     backends.Backend
+	cachePath   string
+	manifests   map[string]string // safe manifest filename -> local path
+}
+
+// reconcileDestinations brings every destination in jobInfo.Destinations up
+// to date with whatever manifests (and the volumes/chunks they reference)
+// the other destinations already have, so that ProcessSmartOptions can pick
+// an incremental base instead of hard-failing the moment destinations
+// disagree. This lets a new mirror destination be added without forcing a
+// fresh full backup of everything that came before it.
+func reconcileDestinations(ctx context.Context, j *helpers.JobInfo) error {
+	states := make([]reconcileDestState, 0, len(j.Destinations))
+	for _, destination := range j.Destinations {
+		backend := prepareBackend(ctx, j, destination, nil)
+		cachePath := getCacheDir(destination)
+		safeManifests, serr := syncCache(ctx, j, cachePath, backend)
+		if serr != nil {
+			return serr
+		}
+		manifests := make(map[string]string, len(safeManifests))
+		for _, m := range safeManifests {
+			manifests[m] = filepath.Join(cachePath, m)
+		}
+		states = append(states, reconcileDestState{destination, backend, cachePath, manifests})
+	}
+
+	// For every manifest known anywhere, remember one destination that
+	// already has a copy of it.
+	owner := make(map[string]string)
+	for _, st := range states {
+		for m := range st.manifests {
+			if _, ok := owner[m]; !ok {
+				owner[m] = st.destination
+			}
+		}
+	}
+
+	for _, dst := range states {
+		missingBySource := make(map[string][]string)
+		for m, src := range owner {
+			if _, ok := dst.manifests[m]; !ok {
+				missingBySource[src] = append(missingBySource[src], m)
+			}
+		}
+		if len(missingBySource) == 0 {
+			continue
+		}
+
+		for src, manifestNames := range missingBySource {
+			var srcState reconcileDestState
+			for _, st := range states {
+				if st.destination == src {
+					srcState = st
+					break
+				}
+			}
+
+			objectNames, err := manifestObjectNames(ctx, j, srcState, manifestNames)
+			if err != nil {
+				return err
+			}
+
+			helpers.AppLogger.Infof("Reconcile: copying %d object(s) to destination %s from %s.", len(objectNames), dst.destination, src)
+			if perr := dst.backend.PreloadFrom(ctx, srcState.backend, objectNames); perr != nil {
+				return perr
+			}
+
+			for _, m := range manifestNames {
+				if cerr := copyLocalFile(srcState.manifests[m], filepath.Join(dst.cachePath, m)); cerr != nil {
+					return cerr
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// manifestObjectNames decodes each named manifest out of src's local cache
+// and returns every backend object name it references: the manifest itself
+// plus every volume or chunk it lists.
+func manifestObjectNames(ctx context.Context, j *helpers.JobInfo, src reconcileDestState, manifestNames []string) ([]string, error) {
+	var objectNames []string
+	for _, m := range manifestNames {
+		decoded, derr := readManifest(ctx, src.manifests[m], j)
+		if derr != nil {
+			return nil, derr
+		}
+		objectNames = append(objectNames, decoded.ObjectName)
+		for _, vol := range decoded.Volumes {
+			objectNames = append(objectNames, vol.ObjectName)
+		}
+		for _, chunk := range decoded.Chunks {
+			objectNames = append(objectNames, chunkObjectName(chunk.Hash))
+		}
+	}
+	return objectNames, nil
+}
+
+func copyLocalFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
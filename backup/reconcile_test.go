@@ -0,0 +1,112 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/someone1/zfsbackup-go/helpers"
+)
+
+func writeTestManifest(t *testing.T, dir, name string, j *helpers.JobInfo) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("could not create test manifest %s - %v", path, err)
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(j); err != nil {
+		t.Fatalf("could not encode test manifest %s - %v", path, err)
+	}
+	return path
+}
+
+func TestManifestObjectNamesCollectsVolumesAndChunks(t *testing.T) {
+	dir := t.TempDir()
+
+	j := &helpers.JobInfo{
+		ObjectName: "manifest-object",
+		Volumes: []*helpers.VolumeInfo{
+			{ObjectName: "vol0"},
+			{ObjectName: "vol1"},
+		},
+		Chunks: []helpers.ChunkRef{
+			{Hash: "aa"},
+			{Hash: "bb"},
+		},
+	}
+	manifestPath := writeTestManifest(t, dir, "safe-manifest", j)
+
+	src := reconcileDestState{
+		destination: "file:///src",
+		manifests:   map[string]string{"safe-manifest": manifestPath},
+	}
+
+	names, err := manifestObjectNames(context.Background(), &helpers.JobInfo{}, src, []string{"safe-manifest"})
+	if err != nil {
+		t.Fatalf("manifestObjectNames() returned error: %v", err)
+	}
+
+	want := []string{"manifest-object", "vol0", "vol1", chunkObjectName("aa"), chunkObjectName("bb")}
+	if len(names) != len(want) {
+		t.Fatalf("manifestObjectNames() = %v, want %v", names, want)
+	}
+	for i, name := range want {
+		if names[i] != name {
+			t.Fatalf("manifestObjectNames()[%d] = %q, want %q", i, names[i], name)
+		}
+	}
+}
+
+func TestManifestObjectNamesMultipleManifests(t *testing.T) {
+	dir := t.TempDir()
+
+	j1 := &helpers.JobInfo{ObjectName: "m1", Volumes: []*helpers.VolumeInfo{{ObjectName: "vol-a"}}}
+	j2 := &helpers.JobInfo{ObjectName: "m2", Volumes: []*helpers.VolumeInfo{{ObjectName: "vol-b"}}}
+
+	src := reconcileDestState{
+		destination: "file:///src",
+		manifests: map[string]string{
+			"m1": writeTestManifest(t, dir, "m1", j1),
+			"m2": writeTestManifest(t, dir, "m2", j2),
+		},
+	}
+
+	names, err := manifestObjectNames(context.Background(), &helpers.JobInfo{}, src, []string{"m1", "m2"})
+	if err != nil {
+		t.Fatalf("manifestObjectNames() returned error: %v", err)
+	}
+
+	want := []string{"m1", "vol-a", "m2", "vol-b"}
+	if len(names) != len(want) {
+		t.Fatalf("manifestObjectNames() = %v, want %v", names, want)
+	}
+	for i, name := range want {
+		if names[i] != name {
+			t.Fatalf("manifestObjectNames()[%d] = %q, want %q", i, names[i], name)
+		}
+	}
+}
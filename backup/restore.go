@@ -0,0 +1,309 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/someone1/zfsbackup-go/backends"
+	"github.com/someone1/zfsbackup-go/helpers"
+)
+
+// restoreStateFileName is where Restore persists enough state to resume a
+// previously interrupted receive.
+const restoreStateFileName = "restore-state.json"
+
+// restoreState is what gets persisted locally so a retried Restore can
+// offer zfs's resume token back and skip the volumes/chunks it already fed
+// to the receiver.
+type restoreState struct {
+	ResumeToken    string `json:"resumeToken"`
+	CompletedParts int    `json:"completedParts"`
+}
+
+// restorePart is one piece of the stream to fetch, in the order it must be
+// fed to zfs receive.
+type restorePart struct {
+	objectName string
+}
+
+// restoreParts returns the ordered list of backend objects that make up the
+// stream to restore, preferring the dedup chunk list when one is present.
+func restoreParts(j *helpers.JobInfo) []restorePart {
+	if len(j.Chunks) > 0 {
+		parts := make([]restorePart, len(j.Chunks))
+		for i, chunk := range j.Chunks {
+			parts[i] = restorePart{objectName: chunkObjectName(chunk.Hash)}
+		}
+		return parts
+	}
+
+	volumes := append([]*helpers.VolumeInfo(nil), j.Volumes...)
+	sort.Sort(helpers.ByVolumeNumber(volumes))
+	parts := make([]restorePart, len(volumes))
+	for i, vol := range volumes {
+		parts[i] = restorePart{objectName: vol.ObjectName}
+	}
+	return parts
+}
+
+func restoreStatePath(j *helpers.JobInfo) string {
+	localCachePath := getCacheDir(j.Destinations[0])
+	return filepath.Join(localCachePath, restoreStateFileName)
+}
+
+func loadRestoreState(j *helpers.JobInfo) restoreState {
+	f, err := os.Open(restoreStatePath(j))
+	if err != nil {
+		return restoreState{}
+	}
+	defer f.Close()
+	var state restoreState
+	if derr := json.NewDecoder(f).Decode(&state); derr != nil {
+		return restoreState{}
+	}
+	return state
+}
+
+func saveRestoreState(j *helpers.JobInfo, state restoreState) error {
+	f, err := os.Create(restoreStatePath(j))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(state)
+}
+
+func clearRestoreState(j *helpers.JobInfo) {
+	if err := os.Remove(restoreStatePath(j)); err != nil && !os.IsNotExist(err) {
+		helpers.AppLogger.Warningf("Could not clear restore state file - %v", err)
+	}
+}
+
+// Restore pulls the volumes (or dedup chunks) referenced by jobInfo's
+// manifest from its destinations, decodes them back into raw ZFS send
+// stream bytes, and feeds them in order into `zfs receive -s`, the
+// counterpart to sendStream/Backup. Downloads for every part are spread
+// across all of j.Destinations and run maxParallel at a time, but are
+// written to the receiver strictly in order, one part at a time, as soon
+// as each part's turn comes up - later parts keep downloading in the
+// background rather than waiting for the whole restore to land in memory
+// first. If the receive is interrupted, the resume token zfs leaves
+// behind is captured, and the count of parts actually fed to the receiver
+// is persisted locally, so a retried Restore can skip what it already
+// sent instead of starting over.
+func Restore(ctx context.Context, j *helpers.JobInfo) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	destBackends := make([]backends.Backend, 0, len(j.Destinations))
+	for _, destination := range j.Destinations {
+		destBackends = append(destBackends, prepareBackend(ctx, j, destination, nil))
+	}
+	defer func() {
+		for _, backend := range destBackends {
+			if cerr := backend.Close(); cerr != nil {
+				helpers.AppLogger.Warningf("Could not properly close backend due to error - %v", cerr)
+			}
+		}
+	}()
+
+	state := loadRestoreState(j)
+	j.RestoreResumeToken = state.ResumeToken
+	completed := state.CompletedParts
+
+	cmd := helpers.GetZFSRecvCommand(ctx, j)
+	pr, pw := io.Pipe()
+	cmd.Stdin = pr
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		helpers.AppLogger.Errorf("Error starting zfs receive command - %v", err)
+		return err
+	}
+
+	maxParallel := j.MaxParallelUploads
+	if maxParallel == 0 {
+		maxParallel = 1
+	}
+
+	onPartComplete := func(completedParts int) error {
+		completed = completedParts
+		return saveRestoreState(j, restoreState{ResumeToken: j.RestoreResumeToken, CompletedParts: completed})
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+
+	group.Go(func() error {
+		defer pw.Close()
+		return downloadInOrder(ctx, destBackends, restoreParts(j), state.CompletedParts, maxParallel, pw, onPartComplete)
+	})
+
+	group.Go(func() error {
+		defer pr.Close()
+		return cmd.Wait()
+	})
+
+	if err := group.Wait(); err != nil {
+		helpers.AppLogger.Errorf("zfs receive failed, attempting to capture a resume token - %v", err)
+		if token, terr := helpers.GetZFSReceiveResumeToken(ctx, j.VolumeName); terr == nil && token != "" {
+			if serr := saveRestoreState(j, restoreState{ResumeToken: token, CompletedParts: completed}); serr != nil {
+				helpers.AppLogger.Warningf("Could not persist restore resume token - %v", serr)
+			}
+		}
+		return err
+	}
+
+	clearRestoreState(j)
+	helpers.AppLogger.Infof("Restore of %s completed successfully.", j.VolumeName)
+	return nil
+}
+
+// downloadInOrder fetches parts[skip:] spread round-robin across
+// destBackends, up to maxParallel downloads in flight at a time, decodes
+// each one into its own temp file on disk (rather than an in-memory
+// buffer, so memory use doesn't scale with maxParallel), and writes them to
+// w strictly in order - regardless of which order the downloads themselves
+// complete in - so later parts keep downloading concurrently while an
+// earlier part is being written. onPartComplete, if non-nil, is called
+// with the total number of parts completed so far, counting the skip
+// parts done before this call (skip + index + 1), right after each one is
+// written, so the caller can persist resume
+// progress as it's made rather than only at the end.
+func downloadInOrder(ctx context.Context, destBackends []backends.Backend, parts []restorePart, skip, maxParallel int, w io.Writer, onPartComplete func(completedParts int) error) error {
+	remaining := parts[skip:]
+	if len(remaining) == 0 {
+		return nil
+	}
+
+	// Each worker decodes its part into its own temp file rather than an
+	// in-memory buffer, so having maxParallel downloads in flight costs
+	// temp files on disk instead of full volumes held in RAM. A worker
+	// frees its download slot once its part is decoded, so finished parts
+	// waiting for their turn stay on disk and the number of temp files is
+	// not bounded by maxParallel.
+	type result struct {
+		path string
+		err  error
+	}
+
+	results := make([]chan result, len(remaining))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	sem := make(chan struct{}, maxParallel)
+	group, ctx := errgroup.WithContext(ctx)
+
+	for i, part := range remaining {
+		i, part := i, part
+		group.Go(func() error {
+			select {
+			case <-ctx.Done():
+				results[i] <- result{err: ctx.Err()}
+				return ctx.Err()
+			case sem <- struct{}{}:
+			}
+			defer func() { <-sem }()
+
+			backend := destBackends[i%len(destBackends)]
+			raw, derr := backend.Download(ctx, part.objectName)
+			if derr != nil {
+				helpers.AppLogger.Errorf("Error downloading %s - %v", part.objectName, derr)
+				results[i] <- result{err: derr}
+				return derr
+			}
+			if closer, ok := raw.(io.Closer); ok {
+				defer closer.Close()
+			}
+
+			tmp, terr := ioutil.TempFile(helpers.BackupTempdir, "zfsbackup-restore-*.part")
+			if terr != nil {
+				results[i] <- result{err: terr}
+				return terr
+			}
+
+			if derr := helpers.DecodeVolume(ctx, raw, tmp); derr != nil {
+				helpers.AppLogger.Errorf("Error decoding %s - %v", part.objectName, derr)
+				tmp.Close()
+				os.Remove(tmp.Name())
+				results[i] <- result{err: derr}
+				return derr
+			}
+			if cerr := tmp.Close(); cerr != nil {
+				os.Remove(tmp.Name())
+				results[i] <- result{err: cerr}
+				return cerr
+			}
+
+			results[i] <- result{path: tmp.Name()}
+			return nil
+		})
+	}
+
+	group.Go(func() error {
+		for i := range remaining {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case res := <-results[i]:
+				if res.err != nil {
+					return res.err
+				}
+				if werr := copyPartAndRemove(res.path, w); werr != nil {
+					return werr
+				}
+				if onPartComplete != nil {
+					if operr := onPartComplete(skip + i + 1); operr != nil {
+						return operr
+					}
+				}
+			}
+		}
+		return nil
+	})
+
+	return group.Wait()
+}
+
+// copyPartAndRemove streams a decoded part's temp file into w and removes
+// the temp file once it's been fully written, regardless of outcome.
+func copyPartAndRemove(path string, w io.Writer) error {
+	defer os.Remove(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
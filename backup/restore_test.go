@@ -0,0 +1,70 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"testing"
+
+	"github.com/someone1/zfsbackup-go/helpers"
+)
+
+func TestRestorePartsPrefersChunks(t *testing.T) {
+	j := &helpers.JobInfo{
+		Chunks: []helpers.ChunkRef{
+			{Hash: "h1"},
+			{Hash: "h2"},
+		},
+		Volumes: []*helpers.VolumeInfo{
+			{ObjectName: "vol1", VolumeNumber: 1},
+		},
+	}
+
+	parts := restoreParts(j)
+
+	if len(parts) != 2 {
+		t.Fatalf("restoreParts() returned %d parts, want 2 (chunks should take priority over volumes)", len(parts))
+	}
+	if parts[0].objectName != chunkObjectName("h1") || parts[1].objectName != chunkObjectName("h2") {
+		t.Fatalf("restoreParts() = %v, want chunk object names in chunk order", parts)
+	}
+}
+
+func TestRestorePartsFallsBackToVolumesInOrder(t *testing.T) {
+	j := &helpers.JobInfo{
+		Volumes: []*helpers.VolumeInfo{
+			{ObjectName: "vol2", VolumeNumber: 2},
+			{ObjectName: "vol0", VolumeNumber: 0},
+			{ObjectName: "vol1", VolumeNumber: 1},
+		},
+	}
+
+	parts := restoreParts(j)
+
+	want := []string{"vol0", "vol1", "vol2"}
+	if len(parts) != len(want) {
+		t.Fatalf("restoreParts() returned %d parts, want %d", len(parts), len(want))
+	}
+	for i, name := range want {
+		if parts[i].objectName != name {
+			t.Fatalf("restoreParts()[%d] = %q, want %q (volumes must be fed to zfs receive in VolumeNumber order)", i, parts[i].objectName, name)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import "time"
+
+// JobInfo describes a single backup job: the options it was run with, and -
+// once run - the snapshot, volumes and timing it produced. It is also the
+// manifest format persisted to every destination and the local cache.
+type JobInfo struct {
+	VolumeName string `json:"volumeName"`
+
+	BaseSnapshot        SnapshotInfo `json:"baseSnapshot"`
+	IncrementalSnapshot SnapshotInfo `json:"incrementalSnapshot"`
+
+	Full            bool          `json:"full"`
+	Incremental     bool          `json:"incremental"`
+	FullIfOlderThan time.Duration `json:"fullIfOlderThan"`
+	Resume          bool          `json:"resume"`
+
+	// Dedup enables content-addressed chunk deduplication for this job: the
+	// raw zfs send stream is chunked and uploaded to backends.Backend under
+	// chunkObjectName(hash) instead of being split into fixed VolumeSize
+	// volumes, and Chunks (rather than Volumes) records what was written.
+	Dedup  bool      `json:"dedup,omitempty"`
+	Chunks []ChunkRef `json:"chunks,omitempty"`
+
+	// Reconcile, when set, tells ProcessSmartOptions to repair destinations
+	// that disagree on what manifests they hold (by copying the missing
+	// manifests and the volumes/chunks they reference from a destination
+	// that has them) instead of hard-failing with "destinations are out of
+	// sync".
+	Reconcile bool `json:"reconcile,omitempty"`
+
+	// ObjectName is the backend object name this JobInfo was (or will be)
+	// saved under as a manifest. It is set on the in-memory JobInfo right
+	// before it's JSON-encoded into its own manifest file, so that anything
+	// that later decodes the manifest - e.g. reconcileDestinations - knows
+	// what to ask a backend for without having to re-derive it.
+	ObjectName string `json:"objectName,omitempty"`
+
+	// RestoreResumeToken is the zfs receive_resume_token captured after an
+	// interrupted Restore, offered back to the next GetZFSRecvCommand call.
+	RestoreResumeToken string `json:"restoreResumeToken,omitempty"`
+
+	Destinations []string `json:"destinations"`
+
+	Compressor string `json:"compressor"`
+	EncryptTo  string `json:"encryptTo"`
+	SignFrom   string `json:"signFrom"`
+
+	VolumeSize         uint64 `json:"volumeSize"`
+	MaxFileBuffer      int    `json:"-"`
+	MaxParallelUploads int    `json:"-"`
+
+	Volumes []*VolumeInfo `json:"volumes,omitempty"`
+
+	ZFSCommandLine string `json:"zfsCommandLine"`
+	ZFSStreamBytes uint64 `json:"zfsStreamBytes"`
+
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+}
+
+// TotalBytesWritten sums the number of bytes actually written to every
+// volume's backend object (i.e. after compression/encryption), used for
+// reporting once a backup finishes.
+func (j *JobInfo) TotalBytesWritten() uint64 {
+	var total uint64
+	for _, vol := range j.Volumes {
+		total += vol.Counter()
+	}
+	return total
+}
+
+// TotalBytesStreamedAndVols reports how many raw zfs stream bytes and how
+// many volumes have already been accounted for in j.Volumes, so sendStream
+// knows how much of a resumed backup it can skip.
+func (j *JobInfo) TotalBytesStreamedAndVols() (uint64, int) {
+	var streamed uint64
+	for _, vol := range j.Volumes {
+		streamed += vol.ZFSStreamBytes
+	}
+	return streamed, len(j.Volumes)
+}
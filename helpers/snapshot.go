@@ -0,0 +1,79 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// SnapshotInfo describes a single ZFS snapshot of a volume.
+type SnapshotInfo struct {
+	Name         string    `json:"name"`
+	CreationTime time.Time `json:"creationTime"`
+}
+
+// Equal reports whether s and other refer to the same snapshot, treating two
+// nil snapshots as equal and a nil and non-nil snapshot as unequal.
+func (s *SnapshotInfo) Equal(other *SnapshotInfo) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+	return s.Name == other.Name
+}
+
+// GetSnapshots returns every snapshot of volume, newest first.
+func GetSnapshots(ctx context.Context, volume string) ([]SnapshotInfo, error) {
+	cmd := exec.CommandContext(ctx, "zfs", "list", "-H", "-p", "-o", "name,creation", "-t", "snapshot", "-s", "creation", volume)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list snapshots for %s: %w", volume, err)
+	}
+
+	var snapshots []SnapshotInfo
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		parts := strings.SplitN(fields[0], "@", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var epoch int64
+		if _, serr := fmt.Sscanf(fields[1], "%d", &epoch); serr != nil {
+			continue
+		}
+		snapshots = append(snapshots, SnapshotInfo{Name: parts[1], CreationTime: time.Unix(epoch, 0)})
+	}
+
+	// Newest first, to match how callers index into the result.
+	for i, j := 0, len(snapshots)-1; i < j; i, j = i+1, j-1 {
+		snapshots[i], snapshots[j] = snapshots[j], snapshots[i]
+	}
+
+	return snapshots, nil
+}
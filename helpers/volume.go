@@ -0,0 +1,209 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/miolini/datacounter"
+)
+
+// VolumeInfo represents a single backend object that makes up a backup - a
+// fixed-size volume, a content-addressed chunk, or the manifest itself -
+// backed by a temporary file on disk so it can be read back for upload,
+// hashed, and re-read on retry.
+type VolumeInfo struct {
+	*os.File
+
+	ObjectName      string `json:"objectName"`
+	VolumeNumber    int    `json:"volumeNumber"`
+	IsManifest      bool   `json:"-"`
+	IsFinalManifest bool   `json:"-"`
+	ZFSStreamBytes  uint64 `json:"zfsStreamBytes"`
+
+	counter *datacounter.WriterCounter
+	hasher  hash.Hash
+	mw      io.Writer
+	gzw     *gzip.Writer
+}
+
+// ByVolumeNumber sorts a slice of volumes by their VolumeNumber, used before
+// a manifest is written so the volume list is always in send order.
+type ByVolumeNumber []*VolumeInfo
+
+func (b ByVolumeNumber) Len() int           { return len(b) }
+func (b ByVolumeNumber) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b ByVolumeNumber) Less(i, j int) bool { return b[i].VolumeNumber < b[j].VolumeNumber }
+
+// newVolume creates the temporary file backing a single backend object and
+// wires up the counting/hashing/compressing writer chain every Create*
+// constructor below shares, so that compression is always applied to
+// exactly what gets uploaded - per volume for CreateBackupVolume, per chunk
+// for CreateChunkVolume - regardless of which one produced it.
+func newVolume(j *JobInfo, objectName string, volNum int, isManifest bool) (*VolumeInfo, error) {
+	f, err := ioutil.TempFile(BackupTempdir, "zfsbackup-*.vol")
+	if err != nil {
+		return nil, err
+	}
+
+	v := &VolumeInfo{
+		File:         f,
+		ObjectName:   objectName,
+		VolumeNumber: volNum,
+		IsManifest:   isManifest,
+		counter:      datacounter.NewWriterCounter(f),
+		hasher:       md5.New(),
+	}
+
+	target := io.MultiWriter(v.counter, v.hasher)
+	if j.Compressor == "gzip" {
+		v.gzw = gzip.NewWriter(target)
+		v.mw = v.gzw
+	} else {
+		v.mw = target
+	}
+
+	return v, nil
+}
+
+// Write implements io.Writer, sending p through compression (if enabled)
+// before it's counted, hashed, and persisted to the temp file.
+func (v *VolumeInfo) Write(p []byte) (int, error) {
+	return v.mw.Write(p)
+}
+
+// Close flushes any pending compressed output and closes the underlying
+// temp file. The file is kept on disk (not removed) so it can still be
+// uploaded or re-read; call DeleteVolume to remove it.
+func (v *VolumeInfo) Close() error {
+	if v.gzw != nil {
+		if err := v.gzw.Close(); err != nil {
+			return err
+		}
+	}
+	return v.File.Close()
+}
+
+// Counter reports how many bytes have been written to the backend object so
+// far (i.e. after compression), used both for upload progress and as the
+// size half of the blob cache's {size, md5} key.
+func (v *VolumeInfo) Counter() uint64 {
+	return v.counter.Count()
+}
+
+// MD5Sum returns the hex-encoded MD5 of the bytes written to the backend
+// object so far.
+func (v *VolumeInfo) MD5Sum() string {
+	return hex.EncodeToString(v.hasher.Sum(nil))
+}
+
+// DeleteVolume removes the temporary file backing this volume.
+func (v *VolumeInfo) DeleteVolume() error {
+	name := v.File.Name()
+	if err := v.File.Close(); err != nil && !strings.Contains(err.Error(), "file already closed") {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// CopyTo copies the volume's temp file to dest, creating any intermediate
+// directories needed.
+func (v *VolumeInfo) CopyTo(dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+		return err
+	}
+
+	in, err := os.Open(v.File.Name())
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// CreateBackupVolume creates the volNum'th fixed-size volume for j.
+func CreateBackupVolume(ctx context.Context, j *JobInfo, volNum int) (*VolumeInfo, error) {
+	objectName := fmt.Sprintf("%s.vol%d", strings.ReplaceAll(j.VolumeName, "/", "_"), volNum)
+	return newVolume(j, objectName, volNum, false)
+}
+
+// CreateChunkVolume creates the content-addressed volume that backs a
+// single dedup chunk, uploaded under objectName (chunkObjectName(hash))
+// rather than a sequential volume name. Chunks aren't part of j.Volumes, so
+// they don't participate in volume numbering.
+func CreateChunkVolume(ctx context.Context, j *JobInfo, objectName string) (*VolumeInfo, error) {
+	return newVolume(j, objectName, -1, false)
+}
+
+// CreateManifestVolume creates the volume that holds the JSON-encoded
+// manifest for j.
+func CreateManifestVolume(ctx context.Context, j *JobInfo) (*VolumeInfo, error) {
+	objectName := fmt.Sprintf("%s.manifest", strings.ReplaceAll(j.VolumeName, "/", "_"))
+	return newVolume(j, objectName, -1, true)
+}
+
+// DecodeVolume reverses the compression CreateBackupVolume/CreateChunkVolume
+// applied, streaming the raw zfs stream bytes a volume or chunk held into w
+// rather than buffering them in memory, so a restore's memory footprint
+// doesn't scale with how many downloads are in flight at once.
+func DecodeVolume(ctx context.Context, r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+
+	// gzip-compressed payloads start with the two-byte magic number; plain
+	// (uncompressed) volumes are copied through as-is. Peek rather than
+	// Read so the magic bytes are still there for gzip.NewReader to see.
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzr, gerr := gzip.NewReader(br)
+		if gerr != nil {
+			return gerr
+		}
+		defer gzr.Close()
+		_, err = io.Copy(w, gzr)
+		return err
+	}
+
+	_, err = io.Copy(w, br)
+	return err
+}
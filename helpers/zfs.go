@@ -0,0 +1,99 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// GetZFSSendCommand builds the `zfs send` command for j, sending an
+// incremental stream from j.IncrementalSnapshot when one is set and a full
+// stream of j.BaseSnapshot otherwise.
+func GetZFSSendCommand(ctx context.Context, j *JobInfo) *exec.Cmd {
+	args := []string{"send"}
+	if j.IncrementalSnapshot.Name != "" {
+		args = append(args, "-i", j.IncrementalSnapshot.Name)
+	}
+	args = append(args, fmt.Sprintf("%s@%s", j.VolumeName, j.BaseSnapshot.Name))
+	return exec.CommandContext(ctx, "zfs", args...)
+}
+
+// GetZFSRecvCommand builds the `zfs receive -s` command Restore streams its
+// reassembled volumes/chunks into. The -s flag tells zfs to save a resume
+// token (retrievable with GetZFSReceiveResumeToken) if the receive is
+// interrupted. -F is only passed on a fresh receive (j.RestoreResumeToken
+// empty); forcing a rollback on a resumed receive would discard the
+// partial-receive state j.RestoreResumeToken depends on.
+func GetZFSRecvCommand(ctx context.Context, j *JobInfo) *exec.Cmd {
+	args := []string{"receive", "-s"}
+	if j.RestoreResumeToken == "" {
+		args = append(args, "-F")
+	}
+	args = append(args, j.VolumeName)
+	return exec.CommandContext(ctx, "zfs", args...)
+}
+
+// EstimateZFSSendSize runs `zfs send -nP` for j, the same stream
+// GetZFSSendCommand would send for real, and parses the "size" line zfs
+// prints in dry-run mode to get an estimate of the stream's total byte
+// count before it starts. Progress reporting uses this as ZFSStreamBytes'
+// initial value so BytesTransferred events have a real denominator from
+// the first sample instead of reporting zero until the stream finishes.
+func EstimateZFSSendSize(ctx context.Context, j *JobInfo) (uint64, error) {
+	args := []string{"send", "-nP"}
+	if j.IncrementalSnapshot.Name != "" {
+		args = append(args, "-i", j.IncrementalSnapshot.Name)
+	}
+	args = append(args, fmt.Sprintf("%s@%s", j.VolumeName, j.BaseSnapshot.Name))
+
+	out, err := exec.CommandContext(ctx, "zfs", args...).Output()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "size" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("could not find size estimate in zfs send -nP output")
+}
+
+// GetZFSReceiveResumeToken reads back the resume token zfs saved for volume
+// after an interrupted `zfs receive -s`, so a retried Restore can persist it
+// for the next attempt.
+func GetZFSReceiveResumeToken(ctx context.Context, volume string) (string, error) {
+	cmd := exec.CommandContext(ctx, "zfs", "get", "-H", "-o", "value", "receive_resume_token", volume)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "-" {
+		return "", nil
+	}
+	return token, nil
+}